@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"unavailable", &gocql.RequestErrUnavailable{}, true},
+		{"timeout no response", gocql.ErrTimeoutNoResponse, true},
+		{"connection closed", gocql.ErrConnectionClosed, true},
+		{"no connections", gocql.ErrNoConnections, true},
+		{"not found", gocql.ErrNotFound, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryable(tc.err); got != tc.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWithRetrySucceedsAfterTransientErrors(t *testing.T) {
+	attempts := 0
+	err := withRetry(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return gocql.ErrTimeoutNoResponse
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry returned %v, want nil", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("fn called %d times, want 3", attempts)
+	}
+}
+
+func TestWithRetryStopsOnNonRetryableError(t *testing.T) {
+	attempts := 0
+	wantErr := errors.New("boom")
+	err := withRetry(context.Background(), func() error {
+		attempts++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("withRetry returned %v, want %v", err, wantErr)
+	}
+	if attempts != 1 {
+		t.Fatalf("fn called %d times, want 1", attempts)
+	}
+}
+
+func TestWithRetryStopsWhenContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := withRetry(ctx, func() error {
+		attempts++
+		return gocql.ErrTimeoutNoResponse
+	})
+	if err != context.Canceled {
+		t.Fatalf("withRetry returned %v, want context.Canceled", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("fn called %d times, want 1", attempts)
+	}
+}
+
+func TestWithRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	start := time.Now()
+	attempts := 0
+	err := withRetry(context.Background(), func() error {
+		attempts++
+		return gocql.ErrTimeoutNoResponse
+	})
+	if err != gocql.ErrTimeoutNoResponse {
+		t.Fatalf("withRetry returned %v, want %v", err, gocql.ErrTimeoutNoResponse)
+	}
+	if attempts != defaultCassandraRetryAttempts {
+		t.Fatalf("fn called %d times, want %d", attempts, defaultCassandraRetryAttempts)
+	}
+	// Delays double from the initial delay between each pair of attempts:
+	// 100+200+400+800ms with the defaults.
+	minBackoff := defaultCassandraRetryInitialDelay * time.Duration(1<<(defaultCassandraRetryAttempts-1)-1)
+	if elapsed := time.Since(start); elapsed < minBackoff {
+		t.Fatalf("withRetry took %v, want at least %v of backoff between attempts", elapsed, minBackoff)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defaults for fanning out FetchFeed's per-feed lookups, overridable via
+// FETCH_CONCURRENCY and FETCH_DEADLINE_SECONDS.
+const (
+	defaultFetchConcurrency  = 16
+	defaultFetchDeadlineSecs = 10
+)
+
+func fetchConcurrency() int {
+	if v := os.Getenv("FETCH_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultFetchConcurrency
+}
+
+func fetchFeedDeadline() time.Duration {
+	if v := os.Getenv("FETCH_DEADLINE_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return defaultFetchDeadlineSecs * time.Second
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "middletier_http_request_duration_seconds",
+		Help: "Duration of HTTP requests handled by the middletier, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	activeRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "middletier_active_requests",
+		Help: "Number of HTTP requests currently being handled.",
+	})
+
+	feedFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "middletier_feed_fetch_duration_seconds",
+		Help: "Duration of upstream feed fetches performed by the poller or on a cache miss, by host.",
+	}, []string{"host"})
+
+	feedFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "middletier_feed_fetch_errors_total",
+		Help: "Count of upstream feed fetch failures, by host and reason.",
+	}, []string{"host", "reason"})
+
+	cassandraQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "middletier_cassandra_query_duration_seconds",
+		Help: "Duration of Cassandra queries, by CQL operation.",
+	}, []string{"op"})
+
+	subscriptionsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "middletier_subscriptions_total",
+		Help: "Total number of rows in the Subscriptions table, sampled periodically.",
+	})
+)
+
+// MetricsHandler exposes the default Prometheus registry, which carries the
+// collectors above (registered there by promauto) alongside the standard
+// go_collector/process_collector runtime metrics that client_golang
+// registers on it by default.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// MetricsMiddleware wraps every route with request duration and
+// in-flight-request instrumentation.
+func MetricsMiddleware(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	activeRequests.Inc()
+	defer activeRequests.Dec()
+
+	start := time.Now()
+	wrapped := &statusCapturingWriter{ResponseWriter: rw, status: http.StatusOK}
+	next(wrapped, r)
+	httpRequestDuration.WithLabelValues(routeLabel(r.URL.Path), r.Method, strconv.Itoa(wrapped.status)).
+		Observe(time.Since(start).Seconds())
+}
+
+type statusCapturingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusCapturingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// routeLabel collapses a request path to its route template so per-user
+// URLs don't blow up cardinality.
+func routeLabel(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/opml"):
+		return "/middletier/rss/user/{user}/opml"
+	case strings.HasPrefix(path, "/middletier/rss/user/"):
+		return "/middletier/rss/user/{user}"
+	case path == "/healthcheck":
+		return "/healthcheck"
+	case path == "/metrics":
+		return "/metrics"
+	default:
+		return "unknown"
+	}
+}
+
+func feedHost(feedURL string) string {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
+
+func cassandraOp(statement string) string {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// StartSubscriptionsGauge launches a background goroutine that periodically
+// samples COUNT(*) from Subscriptions into middletier_subscriptions_total.
+func StartSubscriptionsGauge(ctx context.Context) {
+	interval := time.Duration(envInt("SUBSCRIPTIONS_SAMPLE_INTERVAL_SECONDS", 60)) * time.Second
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			sampleSubscriptionsTotal(ctx)
+		}
+	}()
+}
+
+func sampleSubscriptionsTotal(ctx context.Context) {
+	session, err := GetCassandraSession(ctx)
+	if err != nil {
+		return
+	}
+	var count int64
+	err = withRetry(ctx, func() error {
+		return session.Query(`SELECT COUNT(*) FROM "Subscriptions"`).WithContext(ctx).Scan(&count)
+	})
+	if err != nil {
+		return
+	}
+	subscriptionsTotal.Set(float64(count))
+}
@@ -7,172 +7,230 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gocql/gocql"
 	"github.com/gorilla/mux"
 	"github.com/mmcdole/gofeed"
-	opentracing "github.com/opentracing/opentracing-go"
-	"sourcegraph.com/sourcegraph/appdash"
-	appdashtracer "sourcegraph.com/sourcegraph/appdash/opentracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 )
 
-const CtxSpanID = 0
-
-var collector appdash.Collector
-
-var cassandraAddr string
+// FeedResult carries one subscribed feed's outcome. Status is "ok" or
+// "error" so a slow or failing feed is surfaced to the client instead of
+// being silently dropped from the response.
+type FeedResult struct {
+	URL    string       `json:"url"`
+	Status string       `json:"status"`
+	Error  string       `json:"error,omitempty"`
+	Feed   *gofeed.Feed `json:"feed,omitempty"`
+}
 
 type Subscription struct {
-	Feeds []*gofeed.Feed
+	Feeds []FeedResult `json:"feeds"`
 }
 
 func FetchFeed(w http.ResponseWriter, req *http.Request) {
-	carrier := opentracing.HTTPHeadersCarrier(req.Header)
-	spanCtx, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier)
-	if err != nil {
-		return
-	}
-	span := opentracing.StartSpan("middletier:FetchFeed", opentracing.ChildOf(spanCtx))
-	defer span.Finish()
+	ctx := req.Context()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:FetchFeed")
+	defer span.End()
 
 	vars := mux.Vars(req)
 	user := vars["user"]
-	ctx := context.Background()
-	ctx = opentracing.ContextWithSpan(ctx, span)
 	feedURLs, err := GetUrls(ctx, user)
 	if err != nil {
-		ReturnErrorPage(w, req, err)
+		WriteError(w, err)
 		return
 	}
-	subscription := Subscription{}
-	for _, feedURL := range feedURLs {
-		feed, err := FetchFeedContents(ctx, feedURL)
-		if err != nil {
-			continue
-		}
-		feed.FeedLink = feedURL
-		subscription.Feeds = append(subscription.Feeds, feed)
-	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchFeedDeadline())
+	defer cancel()
+
+	subscription := Subscription{Feeds: fetchFeedsConcurrently(ctx, feedURLs)}
 	json.NewEncoder(w).Encode(subscription)
 }
 
+// fetchFeedContents is a seam over FetchFeedContents so fetchFeedsConcurrently
+// can be unit tested without a live Cassandra session; production code never
+// reassigns it.
+var fetchFeedContents = FetchFeedContents
+
+// fetchFeedsConcurrently fans fetchFeedContents out across a bounded worker
+// pool so one slow feed can't stall the rest, and returns a result per URL
+// (in input order) even when ctx's deadline expires before every feed has
+// been fetched.
+func fetchFeedsConcurrently(ctx context.Context, feedURLs []string) []FeedResult {
+	results := make([]FeedResult, len(feedURLs))
+	sem := make(chan struct{}, fetchConcurrency())
+	g, gctx := errgroup.WithContext(ctx)
+	for i, feedURL := range feedURLs {
+		i, feedURL := i, feedURL
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+				results[i] = FeedResult{URL: feedURL, Status: "error", Error: gctx.Err().Error()}
+				return nil
+			}
+			defer func() { <-sem }()
+
+			feed, err := fetchFeedContents(gctx, feedURL)
+			if err != nil {
+				results[i] = FeedResult{URL: feedURL, Status: "error", Error: err.Error()}
+				return nil
+			}
+			feed.FeedLink = feedURL
+			results[i] = FeedResult{URL: feedURL, Status: "ok", Feed: feed}
+			return nil
+		})
+	}
+	g.Wait()
+	return results
+}
+
 func GetUrls(ctx context.Context, user string) ([]string, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "middletier:GetUrls")
-	defer span.Finish()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:GetUrls")
+	defer span.End()
 
 	session, err := GetCassandraSession(ctx)
 	if err != nil {
-		return nil, errors.New("Cannot connect to cassandra")
+		return nil, err
 	}
-	defer session.Close()
 
-	var feedURL string
 	feedURLs := make([]string, 0)
-	iter := session.Query(`SELECT column1 FROM "Subscriptions" WHERE key = ?`, user).Iter()
-	for iter.Scan(&feedURL) {
-		feedURLs = append(feedURLs, feedURL)
-	}
-	if err := iter.Close(); err != nil {
-		log.Fatal(err)
-		return nil, errors.New("Error fetching data from cassandra")
+	err = withRetry(ctx, func() error {
+		feedURLs = feedURLs[:0]
+		var feedURL string
+		iter := session.Query(`SELECT column1 FROM "Subscriptions" WHERE key = ?`, user).WithContext(ctx).Iter()
+		for iter.Scan(&feedURL) {
+			feedURLs = append(feedURLs, feedURL)
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return nil, errBackend("error fetching data from cassandra")
 	}
 
 	return feedURLs, nil
 }
 
+// FetchFeedContents serves a feed's parsed contents from FeedCache, which is
+// kept fresh by the background poller started in main (see poller.go). Only
+// on a cache miss does it fetch the URL directly, through fetchLiveFeed.
 func FetchFeedContents(ctx context.Context, feedURL string) (*gofeed.Feed, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "middletier:FetchFeedContents")
-	span.SetTag("URL", feedURL)
-	defer span.Finish()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:FetchFeedContents")
+	span.SetAttributes(attribute.String("URL", feedURL))
+	defer span.End()
 
-	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(feedURL)
+	session, err := GetCassandraSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload string
+	err = withRetry(ctx, func() error {
+		return session.Query(`SELECT payload FROM "FeedCache" WHERE url = ?`, feedURL).WithContext(ctx).Scan(&payload)
+	})
+	if err == gocql.ErrNotFound {
+		return fetchLiveFeed(ctx, session, feedURL)
+	}
 	if err != nil {
 		return nil, err
 	}
+
+	feed := &gofeed.Feed{}
+	if err := json.Unmarshal([]byte(payload), feed); err != nil {
+		return nil, err
+	}
 	return feed, nil
 }
 
-func Subscribe(w http.ResponseWriter, req *http.Request) {
-	carrier := opentracing.HTTPHeadersCarrier(req.Header)
-	spanCtx, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier)
-	if err != nil {
-		return
+// validateFeedURL rejects a missing or malformed url form value before it
+// ever reaches Cassandra.
+func validateFeedURL(feedURL string) error {
+	if feedURL == "" {
+		return errors.New("missing url parameter")
 	}
-	span := opentracing.StartSpan("middletier:Subscribe", opentracing.ChildOf(spanCtx))
-	defer span.Finish()
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("invalid url parameter")
+	}
+	return nil
+}
+
+func Subscribe(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:Subscribe")
+	defer span.End()
 
 	vars := mux.Vars(req)
 	user := vars["user"]
 	feedURL := req.FormValue("url")
+	if err := validateFeedURL(feedURL); err != nil {
+		WriteError(w, errBadRequest(err.Error()))
+		return
+	}
 
-	ctx := context.Background()
-	ctx = opentracing.ContextWithSpan(ctx, span)
 	session, err := GetCassandraSession(ctx)
 	if err != nil {
-		log.Fatal(err)
-		ReturnErrorPage(w, req, err)
+		WriteError(w, err)
 		return
 	}
-	defer session.Close()
-	err = session.Query(`INSERT INTO "Subscriptions" (key, column1, value) VALUES (?, ?, ?)`,
-		user, feedURL, "1").Exec()
+	err = withRetry(ctx, func() error {
+		return session.Query(`INSERT INTO "Subscriptions" (key, column1, value) VALUES (?, ?, ?)`,
+			user, feedURL, "1").WithContext(ctx).Exec()
+	})
 	if err != nil {
-		log.Fatal(err)
-		ReturnErrorPage(w, req, err)
+		WriteError(w, errBackend("error writing subscription to cassandra"))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func Unsubscribe(w http.ResponseWriter, req *http.Request) {
-	carrier := opentracing.HTTPHeadersCarrier(req.Header)
-	spanCtx, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier)
-	if err != nil {
-		return
-	}
-	span := opentracing.StartSpan("middletier:Unsubscribe", opentracing.ChildOf(spanCtx))
-	defer span.Finish()
+	ctx := req.Context()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:Unsubscribe")
+	defer span.End()
 
 	vars := mux.Vars(req)
 	user := vars["user"]
 	feedURL := req.FormValue("url")
+	if err := validateFeedURL(feedURL); err != nil {
+		WriteError(w, errBadRequest(err.Error()))
+		return
+	}
 
-	ctx := context.Background()
-	ctx = opentracing.ContextWithSpan(ctx, span)
 	session, err := GetCassandraSession(ctx)
 	if err != nil {
-		log.Fatal(err)
-		ReturnErrorPage(w, req, err)
+		WriteError(w, err)
 		return
 	}
-	defer session.Close()
-	err = session.Query(`DELETE FROM "Subscriptions" WHERE key=? AND column1=?`,
-		user, feedURL).Exec()
+	err = withRetry(ctx, func() error {
+		return session.Query(`DELETE FROM "Subscriptions" WHERE key=? AND column1=?`,
+			user, feedURL).WithContext(ctx).Exec()
+	})
 	if err != nil {
-		log.Fatal(err)
-		ReturnErrorPage(w, req, err)
+		WriteError(w, errBackend("error deleting subscription from cassandra"))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func GetCassandraSession(ctx context.Context) (*gocql.Session, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "middletier:GetCassandraSession")
-	defer span.Finish()
-
-	cluster := gocql.NewCluster(cassandraAddr)
-	cluster.Keyspace = "RSS"
-	cluster.Consistency = gocql.Quorum
-	session, err := cluster.CreateSession()
-	return session, err
-}
-
-func ReturnErrorPage(w http.ResponseWriter, req *http.Request, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(err.Error()))
+// WriteError reports err to the client as structured JSON, using the status
+// carried on an *APIError or falling back to 500 for anything else.
+func WriteError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		apiErr = &APIError{Status: http.StatusInternalServerError, Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: apiErr.Message})
 }
 
 func Healthcheck(w http.ResponseWriter, req *http.Request) {
@@ -180,21 +238,30 @@ func Healthcheck(w http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
-	collector = appdash.NewRemoteCollector("appdash:7701")
-	collector = appdash.NewChunkedCollector(collector)
-	tracer := appdashtracer.NewTracer(collector)
-	opentracing.InitGlobalTracer(tracer)
+	if err := InitTracing("middletier"); err != nil {
+		log.Fatal("cannot initialize tracing:", err)
+	}
 
-	cassandraAddr = os.Getenv("CASSANDRA_ADDR")
+	cassandraAddr := os.Getenv("CASSANDRA_ADDR")
 	fmt.Println("cassandra addr:", cassandraAddr)
+	if err := InitCassandra(cassandraAddr); err != nil {
+		log.Fatal("cannot connect to cassandra:", err)
+	}
+
+	StartFeedPoller(context.Background())
+	StartSubscriptionsGauge(context.Background())
 
 	router := mux.NewRouter()
 	router.HandleFunc("/middletier/rss/user/{user}", FetchFeed).Methods("GET")
 	router.HandleFunc("/middletier/rss/user/{user}", Subscribe).Methods("POST")
 	router.HandleFunc("/middletier/rss/user/{user}", Unsubscribe).Methods("DELETE")
+	router.HandleFunc("/middletier/rss/user/{user}/opml", ImportOPML).Methods("POST")
+	router.HandleFunc("/middletier/rss/user/{user}/opml", ExportOPML).Methods("GET")
+	router.Handle("/metrics", MetricsHandler())
 	router.HandleFunc("/healthcheck", Healthcheck)
 
 	n := negroni.Classic()
-	n.UseHandler(router)
+	n.Use(negroni.HandlerFunc(MetricsMiddleware))
+	n.UseHandler(TraceMiddleware(router))
 	n.Run(":9191")
 }
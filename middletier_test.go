@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+var errTestFetch = errors.New("fetch failed")
+
+func TestValidateFeedURL(t *testing.T) {
+	cases := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"no scheme", "example.com/feed.xml", true},
+		{"no host", "http://", true},
+		{"valid http", "http://example.com/feed.xml", false},
+		{"valid https", "https://example.com/feed.xml", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateFeedURL(tc.url)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateFeedURL(%q) error = %v, wantErr %v", tc.url, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchFeedsConcurrentlyReturnsResultPerURLInOrder(t *testing.T) {
+	orig := fetchFeedContents
+	defer func() { fetchFeedContents = orig }()
+
+	fetchFeedContents = func(ctx context.Context, feedURL string) (*gofeed.Feed, error) {
+		if feedURL == "http://example.com/bad.xml" {
+			return nil, errTestFetch
+		}
+		return &gofeed.Feed{Title: feedURL}, nil
+	}
+
+	urls := []string{"http://example.com/a.xml", "http://example.com/bad.xml", "http://example.com/c.xml"}
+	results := fetchFeedsConcurrently(context.Background(), urls)
+
+	if len(results) != len(urls) {
+		t.Fatalf("got %d results, want %d", len(results), len(urls))
+	}
+	for i, url := range urls {
+		if results[i].URL != url {
+			t.Errorf("result %d URL = %q, want %q", i, results[i].URL, url)
+		}
+	}
+	if results[0].Status != "ok" || results[2].Status != "ok" {
+		t.Errorf("expected ok results for a.xml and c.xml, got %+v", results)
+	}
+	if results[1].Status != "error" {
+		t.Errorf("expected error result for bad.xml, got %+v", results[1])
+	}
+}
+
+func TestFetchFeedsConcurrentlyStopsAtDeadline(t *testing.T) {
+	orig := fetchFeedContents
+	defer func() { fetchFeedContents = orig }()
+
+	fetchFeedContents = func(ctx context.Context, feedURL string) (*gofeed.Feed, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	urls := []string{"http://example.com/a.xml", "http://example.com/b.xml"}
+	results := fetchFeedsConcurrently(ctx, urls)
+
+	for i, r := range results {
+		if r.Status != "error" {
+			t.Errorf("result %d = %+v, want an error result once the deadline elapses", i, r)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"net/http"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+)
+
+// opmlOutline mirrors a single <outline> element, which may itself nest
+// further outlines (used by readers to group feeds into categories).
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr"`
+	XMLURL   string        `xml:"xmlUrl,attr"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlBody struct {
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlHead struct {
+	Title string `xml:"title"`
+}
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    opmlHead `xml:"head"`
+	Body    opmlBody `xml:"body"`
+}
+
+// subscriptionEntry is a single feed subscription, optionally grouped under
+// a category taken from its parent outline's title.
+type subscriptionEntry struct {
+	URL      string
+	Category string
+}
+
+// walkOutlines flattens a nested OPML outline tree into subscription
+// entries. An outline with an xmlUrl attribute is a feed; an outline
+// without one is treated as a category, named by its title (or its text
+// when it has no title), and feeds nested beneath it take the name of
+// their nearest enclosing category.
+func walkOutlines(outlines []opmlOutline, category string) []subscriptionEntry {
+	entries := make([]subscriptionEntry, 0, len(outlines))
+	for _, o := range outlines {
+		if o.XMLURL != "" {
+			entries = append(entries, subscriptionEntry{URL: o.XMLURL, Category: category})
+			continue
+		}
+		childCategory := o.Title
+		if childCategory == "" {
+			childCategory = o.Text
+		}
+		entries = append(entries, walkOutlines(o.Outlines, childCategory)...)
+	}
+	return entries
+}
+
+// ImportOPML parses an uploaded OPML 2.0 document and replaces the user's
+// Subscriptions. A first batch snapshots the previous set to
+// SubscriptionsBackup and deletes rows the import drops or recategorizes;
+// a second batch inserts the new and recategorized feeds. Feed outlines
+// whose xmlUrl fails the validation Subscribe applies to a single feed are
+// logged and skipped.
+func ImportOPML(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:ImportOPML")
+	defer span.End()
+
+	vars := mux.Vars(req)
+	user := vars["user"]
+
+	var doc opmlDocument
+	if err := xml.NewDecoder(req.Body).Decode(&doc); err != nil {
+		WriteError(w, errBadRequest("invalid OPML document"))
+		return
+	}
+	entries := walkOutlines(doc.Body.Outlines, "")
+	valid := make([]subscriptionEntry, 0, len(entries))
+	for _, entry := range entries {
+		if err := validateFeedURL(entry.URL); err != nil {
+			log.Println("opml: skipping invalid outline url", entry.URL, ":", err)
+			continue
+		}
+		valid = append(valid, entry)
+	}
+	entries = valid
+	if len(entries) == 0 {
+		WriteError(w, errBadRequest("OPML document contains no valid feeds"))
+		return
+	}
+
+	session, err := GetCassandraSession(ctx)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	current, err := subscriptionsForUser(ctx, session, user)
+	if err != nil {
+		WriteError(w, errBackend("error reading existing subscriptions from cassandra"))
+		return
+	}
+
+	newByURL := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		newByURL[entry.URL] = entry.Category
+	}
+
+	backup := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	for _, row := range current {
+		backup.Query(`INSERT INTO "SubscriptionsBackup" (key, column1, value, category) VALUES (?, ?, ?, ?)`,
+			user, row.URL, "1", row.Category)
+		// Only delete rows that the re-import drops or recategorizes; an
+		// unchanged URL must not be DELETEd and re-INSERTed in the same
+		// batch, since gocql issues one client timestamp for the whole
+		// batch and Cassandra resolves the tie in favor of the tombstone,
+		// silently dropping the subscription.
+		if newCategory, ok := newByURL[row.URL]; !ok || newCategory != row.Category {
+			backup.Query(`DELETE FROM "Subscriptions" WHERE key = ? AND column1 = ?`, user, row.URL)
+		}
+	}
+	err = withRetry(ctx, func() error {
+		return session.ExecuteBatch(backup)
+	})
+	if err != nil {
+		WriteError(w, errBackend("error writing subscriptions to cassandra"))
+		return
+	}
+
+	currentByURL := make(map[string]string, len(current))
+	for _, row := range current {
+		currentByURL[row.URL] = row.Category
+	}
+	insert := session.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	for _, entry := range entries {
+		if oldCategory, ok := currentByURL[entry.URL]; ok && oldCategory == entry.Category {
+			continue
+		}
+		insert.Query(`INSERT INTO "Subscriptions" (key, column1, value, category) VALUES (?, ?, ?, ?)`,
+			user, entry.URL, "1", entry.Category)
+	}
+	if insert.Size() > 0 {
+		err = withRetry(ctx, func() error {
+			return session.ExecuteBatch(insert)
+		})
+		if err != nil {
+			WriteError(w, errBackend("error writing subscriptions to cassandra"))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ExportOPML emits the user's current subscriptions as an OPML 2.0
+// document, grouping feeds back under their stored category.
+func ExportOPML(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:ExportOPML")
+	defer span.End()
+
+	vars := mux.Vars(req)
+	user := vars["user"]
+
+	session, err := GetCassandraSession(ctx)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	entries, err := subscriptionsForUser(ctx, session, user)
+	if err != nil {
+		WriteError(w, errBackend("error reading subscriptions from cassandra"))
+		return
+	}
+
+	doc := buildOPMLDocument(user, entries)
+	w.Header().Set("Content-Type", "text/x-opml")
+	w.WriteHeader(http.StatusOK)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(doc)
+}
+
+func subscriptionsForUser(ctx context.Context, session *gocql.Session, user string) ([]subscriptionEntry, error) {
+	var entries []subscriptionEntry
+	err := withRetry(ctx, func() error {
+		entries = entries[:0]
+		var url, category string
+		iter := session.Query(`SELECT column1, category FROM "Subscriptions" WHERE key = ?`, user).WithContext(ctx).Iter()
+		for iter.Scan(&url, &category) {
+			entries = append(entries, subscriptionEntry{URL: url, Category: category})
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// buildOPMLDocument groups flat subscription entries back into a category
+// outline tree, mirroring the structure walkOutlines flattens on import.
+func buildOPMLDocument(user string, entries []subscriptionEntry) opmlDocument {
+	var uncategorized []opmlOutline
+	categories := make(map[string]*opmlOutline)
+	var order []string
+
+	for _, entry := range entries {
+		feed := opmlOutline{Text: entry.URL, XMLURL: entry.URL}
+		if entry.Category == "" {
+			uncategorized = append(uncategorized, feed)
+			continue
+		}
+		cat, ok := categories[entry.Category]
+		if !ok {
+			cat = &opmlOutline{Text: entry.Category, Title: entry.Category}
+			categories[entry.Category] = cat
+			order = append(order, entry.Category)
+		}
+		cat.Outlines = append(cat.Outlines, feed)
+	}
+
+	outlines := append([]opmlOutline{}, uncategorized...)
+	for _, name := range order {
+		outlines = append(outlines, *categories[name])
+	}
+
+	return opmlDocument{
+		Version: "2.0",
+		Head:    opmlHead{Title: user + " subscriptions"},
+		Body:    opmlBody{Outlines: outlines},
+	}
+}
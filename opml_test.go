@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+
+func TestWalkOutlinesFlattensCategories(t *testing.T) {
+	outlines := []opmlOutline{
+		{XMLURL: "http://example.com/uncategorized.xml"},
+		{
+			Title: "News",
+			Outlines: []opmlOutline{
+				{XMLURL: "http://example.com/a.xml"},
+				{XMLURL: "http://example.com/b.xml"},
+			},
+		},
+		{
+			Text: "Tech",
+			Outlines: []opmlOutline{
+				{XMLURL: "http://example.com/c.xml"},
+			},
+		},
+	}
+
+	got := walkOutlines(outlines, "")
+
+	want := []subscriptionEntry{
+		{URL: "http://example.com/uncategorized.xml", Category: ""},
+		{URL: "http://example.com/a.xml", Category: "News"},
+		{URL: "http://example.com/b.xml", Category: "News"},
+		{URL: "http://example.com/c.xml", Category: "Tech"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("walkOutlines returned %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWalkOutlinesNestedCategoriesInheritNearestTitle(t *testing.T) {
+	outlines := []opmlOutline{
+		{
+			Title: "Outer",
+			Outlines: []opmlOutline{
+				{
+					Title: "Inner",
+					Outlines: []opmlOutline{
+						{XMLURL: "http://example.com/nested.xml"},
+					},
+				},
+			},
+		},
+	}
+
+	got := walkOutlines(outlines, "")
+	if len(got) != 1 {
+		t.Fatalf("walkOutlines returned %d entries, want 1", len(got))
+	}
+	if got[0].Category != "Inner" {
+		t.Errorf("category = %q, want %q", got[0].Category, "Inner")
+	}
+}
+
+func TestBuildOPMLDocumentGroupsByCategory(t *testing.T) {
+	entries := []subscriptionEntry{
+		{URL: "http://example.com/uncategorized.xml"},
+		{URL: "http://example.com/a.xml", Category: "News"},
+		{URL: "http://example.com/b.xml", Category: "News"},
+	}
+
+	doc := buildOPMLDocument("alice", entries)
+
+	if doc.Version != "2.0" {
+		t.Errorf("Version = %q, want 2.0", doc.Version)
+	}
+	if doc.Head.Title != "alice subscriptions" {
+		t.Errorf("Head.Title = %q, want %q", doc.Head.Title, "alice subscriptions")
+	}
+	if len(doc.Body.Outlines) != 2 {
+		t.Fatalf("got %d top-level outlines, want 2 (1 uncategorized feed + 1 category): %+v", len(doc.Body.Outlines), doc.Body.Outlines)
+	}
+	if doc.Body.Outlines[0].XMLURL != "http://example.com/uncategorized.xml" {
+		t.Errorf("uncategorized outline = %+v", doc.Body.Outlines[0])
+	}
+	category := doc.Body.Outlines[1]
+	if category.Title != "News" || len(category.Outlines) != 2 {
+		t.Errorf("category outline = %+v, want News with 2 feeds", category)
+	}
+}
+
+func TestWalkOutlinesThenBuildOPMLDocumentRoundTrips(t *testing.T) {
+	original := []opmlOutline{
+		{
+			Title: "News",
+			Outlines: []opmlOutline{
+				{XMLURL: "http://example.com/a.xml"},
+			},
+		},
+	}
+
+	entries := walkOutlines(original, "")
+	doc := buildOPMLDocument("alice", entries)
+
+	if len(doc.Body.Outlines) != 1 || doc.Body.Outlines[0].Title != "News" {
+		t.Fatalf("round trip lost the News category: %+v", doc.Body.Outlines)
+	}
+	if len(doc.Body.Outlines[0].Outlines) != 1 || doc.Body.Outlines[0].Outlines[0].XMLURL != "http://example.com/a.xml" {
+		t.Fatalf("round trip lost the feed: %+v", doc.Body.Outlines[0].Outlines)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mmcdole/gofeed"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Default poller settings, overridable via POLL_WORKER_POOL_SIZE,
+// POLL_INTERVAL_SECONDS and POLL_FEED_TIMEOUT_SECONDS.
+const (
+	defaultPollWorkerPoolSize  = 8
+	defaultPollIntervalSecs    = 900
+	defaultPollFeedTimeoutSecs = 30
+)
+
+// StartFeedPoller runs an initial poll cycle synchronously, so FeedCache is
+// populated before the process starts serving requests, then launches a
+// background goroutine that repeats the poll every POLL_INTERVAL_SECONDS.
+// It returns once that first cycle completes; the recurring poll loop runs
+// until the process exits.
+func StartFeedPoller(ctx context.Context) {
+	pollAllFeeds(ctx)
+
+	interval := time.Duration(pollIntervalSeconds()) * time.Second
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			pollAllFeeds(ctx)
+		}
+	}()
+}
+
+func pollIntervalSeconds() int {
+	if v := os.Getenv("POLL_INTERVAL_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultPollIntervalSecs
+}
+
+func pollWorkerPoolSize() int {
+	if v := os.Getenv("POLL_WORKER_POOL_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultPollWorkerPoolSize
+}
+
+// pollFeedTimeout bounds a single feed's fetch within a poll cycle, so one
+// slow or unreachable upstream can't wedge the cycle (and, since
+// StartFeedPoller runs the first cycle synchronously, can't wedge process
+// startup either).
+func pollFeedTimeout() time.Duration {
+	if v := os.Getenv("POLL_FEED_TIMEOUT_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return defaultPollFeedTimeoutSecs * time.Second
+}
+
+// pollAllFeeds refreshes every distinct feed URL currently subscribed to by
+// at least one user.
+func pollAllFeeds(ctx context.Context) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:PollCycle")
+	defer span.End()
+
+	session, err := GetCassandraSession(ctx)
+	if err != nil {
+		log.Println("poller: cannot connect to cassandra:", err)
+		return
+	}
+
+	urls, err := distinctFeedURLs(ctx, session)
+	if err != nil {
+		log.Println("poller: cannot list subscriptions:", err)
+		return
+	}
+	span.SetAttributes(attribute.Int("feeds", len(urls)))
+
+	sem := make(chan struct{}, pollWorkerPoolSize())
+	done := make(chan struct{}, len(urls))
+	for _, url := range urls {
+		sem <- struct{}{}
+		go func(feedURL string) {
+			defer func() { <-sem; done <- struct{}{} }()
+			feedCtx, cancel := context.WithTimeout(ctx, pollFeedTimeout())
+			defer cancel()
+			if err := pollFeed(feedCtx, session, feedURL); err != nil {
+				log.Println("poller: failed to refresh", feedURL, ":", err)
+			}
+		}(url)
+	}
+	for range urls {
+		<-done
+	}
+}
+
+func distinctFeedURLs(ctx context.Context, session *gocql.Session) ([]string, error) {
+	seen := make(map[string]bool)
+	urls := make([]string, 0)
+	err := withRetry(ctx, func() error {
+		seen = make(map[string]bool)
+		urls = urls[:0]
+		var url string
+		iter := session.Query(`SELECT column1 FROM "Subscriptions"`).WithContext(ctx).Iter()
+		for iter.Scan(&url) {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// pollFeed conditionally refreshes a single feed URL, using the ETag and
+// Last-Modified values stored from its previous fetch, and writes the
+// parsed result plus next-poll timestamp back to FeedCache.
+func pollFeed(ctx context.Context, session *gocql.Session, feedURL string) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "middletier:pollFeed")
+	span.SetAttributes(attribute.String("URL", feedURL))
+	defer span.End()
+
+	var etag, lastModified string
+	var nextUpdate time.Time
+	err := withRetry(ctx, func() error {
+		return session.Query(`SELECT etag, last_modified, next_update FROM "FeedCache" WHERE url = ?`, feedURL).
+			WithContext(ctx).Scan(&etag, &lastModified, &nextUpdate)
+	})
+	if err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+	if !nextUpdate.IsZero() && time.Now().Before(nextUpdate) {
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", feedURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	host := feedHost(feedURL)
+	fetchStart := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	feedFetchDuration.WithLabelValues(host).Observe(time.Since(fetchStart).Seconds())
+	if err != nil {
+		feedFetchErrors.WithLabelValues(host, "request_error").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+
+	next := time.Now().Add(time.Duration(pollIntervalSeconds()) * time.Second)
+	if resp.StatusCode == http.StatusNotModified {
+		return withRetry(ctx, func() error {
+			return session.Query(`UPDATE "FeedCache" SET next_update = ? WHERE url = ?`, next, feedURL).WithContext(ctx).Exec()
+		})
+	}
+	if resp.StatusCode >= 400 {
+		feedFetchErrors.WithLabelValues(host, "status_"+strconv.Itoa(resp.StatusCode)).Inc()
+		return fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, feedURL)
+	}
+
+	fp := gofeed.NewParser()
+	feed, err := fp.Parse(resp.Body)
+	if err != nil {
+		feedFetchErrors.WithLabelValues(host, "parse_error").Inc()
+		return err
+	}
+	feed.FeedLink = feedURL
+
+	return storeFeedCache(ctx, session, feedURL, feed, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), next)
+}
+
+// storeFeedCache writes a freshly fetched feed, along with the conditional
+// request metadata needed to refresh it later, into FeedCache.
+func storeFeedCache(ctx context.Context, session *gocql.Session, feedURL string, feed *gofeed.Feed, etag, lastModified string, next time.Time) error {
+	payload, err := json.Marshal(feed)
+	if err != nil {
+		return err
+	}
+	return withRetry(ctx, func() error {
+		return session.Query(
+			`UPDATE "FeedCache" SET etag = ?, last_modified = ?, next_update = ?, payload = ? WHERE url = ?`,
+			etag, lastModified, next, string(payload), feedURL,
+		).WithContext(ctx).Exec()
+	})
+}
+
+// fetchLiveFeed fetches and parses a feed directly, bypassing FeedCache.
+// It's used as a fallback when FetchFeedContents sees a cache miss — e.g. a
+// subscription added since the last poll cycle, or a cold FeedCache on a
+// fresh deploy — so the request path never has to wait for the next poll
+// tick. The result is opportunistically written back to FeedCache so later
+// requests and poll cycles find it there.
+func fetchLiveFeed(ctx context.Context, session *gocql.Session, feedURL string) (*gofeed.Feed, error) {
+	host := feedHost(feedURL)
+	fetchStart := time.Now()
+	fp := gofeed.NewParser()
+	feed, err := fp.ParseURLWithContext(feedURL, ctx)
+	feedFetchDuration.WithLabelValues(host).Observe(time.Since(fetchStart).Seconds())
+	if err != nil {
+		feedFetchErrors.WithLabelValues(host, "live_fetch_error").Inc()
+		return nil, err
+	}
+	feed.FeedLink = feedURL
+
+	next := time.Now().Add(time.Duration(pollIntervalSeconds()) * time.Second)
+	go storeFeedCache(context.Background(), session, feedURL, feed, "", "", next)
+
+	return feed, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+const tracerName = "middletier"
+
+// InitTracing configures the global OpenTelemetry TracerProvider. The
+// exporter is selected with OTEL_EXPORTER (otlp|zipkin|jaeger|stdout,
+// defaulting to stdout) and the sampling ratio with OTEL_SAMPLE_RATIO
+// (defaulting to always-on).
+func InitTracing(serviceName string) error {
+	exporter, err := newExporter()
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(semconv.ServiceNameKey.String(serviceName)))
+	if err != nil {
+		return err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio()))),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+func newExporter() (sdktrace.SpanExporter, error) {
+	switch os.Getenv("OTEL_EXPORTER") {
+	case "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		return otlptracegrpc.New(context.Background(),
+			otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	case "zipkin":
+		return zipkin.New(os.Getenv("OTEL_EXPORTER_ZIPKIN_ENDPOINT"))
+	case "jaeger":
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(os.Getenv("OTEL_EXPORTER_JAEGER_ENDPOINT"))))
+	default:
+		return stdouttrace.New()
+	}
+}
+
+func sampleRatio() float64 {
+	if v := os.Getenv("OTEL_SAMPLE_RATIO"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			return f
+		}
+	}
+	return 1
+}
+
+// TraceMiddleware wraps h so every request propagates and starts a span from
+// the incoming W3C traceparent header.
+func TraceMiddleware(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, fmt.Sprintf("%s:http", tracerName))
+}